@@ -0,0 +1,147 @@
+package libvirt
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestFileWebServerTLS(t *testing.T) {
+	fws := &fileWebServer{TLS: true}
+	if err := fws.Start(); err != nil {
+		t.Fatalf("Start: %s", err)
+	}
+	defer fws.Stop()
+
+	if got := fws.URL[:8]; got != "https://" {
+		t.Fatalf("URL = %q, want an https:// scheme", fws.URL)
+	}
+
+	url, _, _, _, err := fws.AddContent([]byte("tls content"))
+	if err != nil {
+		t.Fatalf("AddContent: %s", err)
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatalf("Get over TLS: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestFileWebServerMTLSRejectsUnknownClient(t *testing.T) {
+	pool := x509.NewCertPool()
+	fws := &fileWebServer{TLS: true, ClientCAs: pool}
+	if err := fws.Start(); err != nil {
+		t.Fatalf("Start: %s", err)
+	}
+	defer fws.Stop()
+
+	url, _, _, _, err := fws.AddContent([]byte("mtls content"))
+	if err != nil {
+		t.Fatalf("AddContent: %s", err)
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+
+	if _, err := client.Get(url); err == nil {
+		t.Fatal("expected the handshake to fail without a client certificate")
+	}
+}
+
+func TestFileWebServerMTLSAcceptsValidClient(t *testing.T) {
+	clientCert, clientCA, err := generateSelfSignedClientCert()
+	if err != nil {
+		t.Fatalf("generateSelfSignedClientCert: %s", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(clientCA)
+
+	fws := &fileWebServer{TLS: true, ClientCAs: pool}
+	if err := fws.Start(); err != nil {
+		t.Fatalf("Start: %s", err)
+	}
+	defer fws.Stop()
+
+	url, _, _, _, err := fws.AddContent([]byte("mtls content"))
+	if err != nil {
+		t.Fatalf("AddContent: %s", err)
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			Certificates:       []tls.Certificate{clientCert},
+		},
+	}}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatalf("Get with a valid client certificate: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+// generateSelfSignedClientCert creates an in-memory self-signed certificate
+// suitable for use as a client certificate in an mTLS handshake, returning
+// both the keypair and the parsed *x509.Certificate to add to a ClientCAs
+// pool.
+func generateSelfSignedClientCert() (tls.Certificate, *x509.Certificate, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "test-client"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        cert,
+	}, cert, nil
+}
@@ -1,87 +1,539 @@
 package libvirt
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"math/rand"
+	"math/big"
+	mrand "math/rand"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 const (
 	maxIfaceNum = 100
+
+	// defaultMACOUI is the QEMU/libvirt-assigned OUI used when the provider
+	// isn't configured with a mac_oui override.
+	defaultMACOUI = "52:54:00"
+
+	// maxMACAllocAttempts bounds retries when a generated MAC collides with
+	// one already handed out in this run, so a saturated allocator fails
+	// loudly instead of spinning forever.
+	maxMACAllocAttempts = 100
 )
 
-// randomMACAddress returns a randomized MAC address
-// with libvirt prefix
-func randomMACAddress() (string, error) {
-	buf := make([]byte, 3)
-	rand.Seed(time.Now().UnixNano())
-	_, err := rand.Read(buf)
+// macAllocator hands out MAC addresses for domain NICs over the lifetime of
+// a single Terraform run. It seeds its randomness once from crypto/rand
+// (rather than reseeding math/rand from wall-clock time on every call, which
+// correlates badly when many NICs are created within the same second),
+// tracks every address it has handed out so it can retry on collision, and
+// can optionally derive a stable address from (domain name, interface
+// index) so `terraform plan` output doesn't change across re-runs.
+//
+// A single macAllocator must be shared by every NIC created in the same
+// run for the collision tracking to mean anything; defaultMACAllocator /
+// randomMACAddress below is that shared instance until the provider's
+// Config/meta plumbing (outside this tree's current snapshot) constructs
+// one from the `mac_oui` provider setting and threads it through instead.
+type macAllocator struct {
+	oui [3]byte
+
+	mu            sync.Mutex
+	rnd           *mrand.Rand
+	allocated     map[string]bool
+	deterministic bool
+}
+
+// newMACAllocator builds a macAllocator using ouiPrefix (a colon-separated
+// 3-octet prefix such as "52:54:00"); an empty prefix falls back to
+// defaultMACOUI. When deterministic is true, Allocate derives the address
+// from its (domainName, ifaceIndex) arguments instead of drawing from rnd.
+func newMACAllocator(ouiPrefix string, deterministic bool) (*macAllocator, error) {
+	oui, err := parseMACOUI(ouiPrefix)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	seed, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return nil, fmt.Errorf("error seeding MAC allocator: %s", err)
+	}
+
+	return &macAllocator{
+		oui:           oui,
+		rnd:           mrand.New(mrand.NewSource(seed.Int64())),
+		allocated:     make(map[string]bool),
+		deterministic: deterministic,
+	}, nil
+}
+
+var (
+	defaultMACAllocatorOnce sync.Once
+	defaultMACAllocator     *macAllocator
+)
+
+// randomMACAddress returns a MAC address under the default
+// ("52:54:00") OUI, drawn from the shared defaultMACAllocator so
+// addresses don't collide across NICs created in the same run. It
+// replaces the old reseed-math/rand-per-call randomMACAddress.
+func randomMACAddress() (string, error) {
+	defaultMACAllocatorOnce.Do(func() {
+		// newMACAllocator only fails if ouiPrefix is malformed, and
+		// defaultMACOUI is a constant we control.
+		defaultMACAllocator, _ = newMACAllocator(defaultMACOUI, false)
+	})
+	return defaultMACAllocator.Allocate("", 0)
+}
+
+// parseMACOUI parses a "xx:xx:xx" OUI prefix, defaulting to defaultMACOUI
+// when prefix is empty.
+func parseMACOUI(prefix string) ([3]byte, error) {
+	var oui [3]byte
+	if prefix == "" {
+		prefix = defaultMACOUI
+	}
+
+	octets := strings.Split(prefix, ":")
+	if len(octets) != 3 {
+		return oui, fmt.Errorf("mac_oui %q must be 3 colon-separated hex octets, e.g. %q", prefix, defaultMACOUI)
+	}
+
+	for i, octet := range octets {
+		v, err := strconv.ParseUint(octet, 16, 8)
+		if err != nil {
+			return oui, fmt.Errorf("mac_oui %q: invalid octet %q: %s", prefix, octet, err)
+		}
+		oui[i] = byte(v)
+	}
+
+	return oui, nil
+}
+
+// Allocate returns a MAC address under a.oui that has not yet been handed
+// out by this allocator. domainName/ifaceIndex are only consulted in
+// deterministic mode, where they seed the address instead of a.rnd.
+func (a *macAllocator) Allocate(domainName string, ifaceIndex int) (string, error) {
+	for attempt := 0; attempt < maxMACAllocAttempts; attempt++ {
+		var suffix [3]byte
+		if a.deterministic {
+			h := sha256.Sum256([]byte(fmt.Sprintf("%s/%d/%d", domainName, ifaceIndex, attempt)))
+			copy(suffix[:], h[:3])
+		} else {
+			a.mu.Lock()
+			a.rnd.Read(suffix[:])
+			a.mu.Unlock()
+		}
+
+		mac := a.format(suffix)
+
+		a.mu.Lock()
+		taken := a.allocated[mac]
+		if !taken {
+			a.allocated[mac] = true
+		}
+		a.mu.Unlock()
+
+		if !taken {
+			return mac, nil
+		}
 	}
 
+	return "", fmt.Errorf("could not allocate a unique MAC address under OUI %02x:%02x:%02x after %d attempts",
+		a.oui[0], a.oui[1], a.oui[2], maxMACAllocAttempts)
+}
+
+// format combines a.oui with a generated suffix. The local/unicast bit
+// pattern and the 0xfe -> 0xee substitution are applied to the first suffix
+// octet (the fourth octet of the address); the OUI octets are used as given.
+func (a *macAllocator) format(suffix [3]byte) string {
 	// set local bit and unicast
-	buf[0] = (buf[0] | 2) & 0xfe
+	suffix[0] = (suffix[0] | 2) & 0xfe
 	// Set the local bit
-	buf[0] |= 2
+	suffix[0] |= 2
 
 	// avoid libvirt-reserved addresses
-	if buf[0] == 0xfe {
-		buf[0] = 0xee
+	if suffix[0] == 0xfe {
+		suffix[0] = 0xee
+	}
+
+	return fmt.Sprintf("%02x:%02x:%02x:%02x:%02x:%02x",
+		a.oui[0], a.oui[1], a.oui[2], suffix[0], suffix[1], suffix[2])
+}
+
+// AddrRange is an inclusive, contiguous range of addresses within Prefix. It
+// is the netip-native replacement for juggling a (first, last net.IP) pair:
+// addresses compare with ==, and the range is allocation-free to construct.
+type AddrRange struct {
+	First, Last netip.Addr
+	Prefix      netip.Prefix
+}
+
+// Contains reports whether addr falls within [r.First, r.Last].
+func (r AddrRange) Contains(addr netip.Addr) bool {
+	return addr.Compare(r.First) >= 0 && addr.Compare(r.Last) <= 0
+}
+
+// Len returns the number of addresses in the range, inclusive of both ends.
+// It is a *big.Int since an IPv6 range can vastly exceed 64 bits.
+func (r AddrRange) Len() *big.Int {
+	n := new(big.Int).Sub(addrToBigInt(r.Last), addrToBigInt(r.First))
+	return n.Add(n, big.NewInt(1))
+}
+
+// Iterate calls fn for every address in the range, in order, stopping early
+// if fn returns false.
+func (r AddrRange) Iterate(fn func(netip.Addr) bool) {
+	for a := r.First; ; a = a.Next() {
+		if !fn(a) {
+			return
+		}
+		if a == r.Last {
+			return
+		}
+	}
+}
+
+func addrToBigInt(a netip.Addr) *big.Int {
+	return new(big.Int).SetBytes(a.AsSlice())
+}
+
+// capPrefixHostBits returns p narrowed, where needed, to a prefix with at
+// most 16 host bits, since libvirt only supports 65535 IPs per subnet
+// (2^16 = 65536, minus broadcast and .1).
+func capPrefixHostBits(p netip.Prefix) netip.Prefix {
+	total := p.Addr().BitLen()
+	if total-p.Bits() > 16 {
+		return netip.PrefixFrom(p.Addr(), total-16)
+	}
+	return p
+}
+
+// lastAddr returns the broadcast-style last address of p (all ones in the
+// host part).
+func lastAddr(p netip.Prefix) netip.Addr {
+	buf := p.Addr().AsSlice()
+	for i := p.Bits(); i < len(buf)*8; i++ {
+		buf[i/8] |= 1 << (7 - uint(i%8))
+	}
+	addr, _ := netip.AddrFromSlice(buf)
+	return addr
+}
+
+// addrRangeContaining computes the 16-bit-capped AddrRange within outer that
+// contains addr: the same "max 16 bits for hosts" truncation networkRange
+// has always applied, just anchored at addr instead of always at the start
+// of the network.
+func addrRangeContaining(outer netip.Prefix, addr netip.Addr) (AddrRange, bool) {
+	if !outer.Contains(addr) {
+		return AddrRange{}, false
+	}
+
+	window := netip.PrefixFrom(addr, capPrefixHostBits(outer).Bits()).Masked()
+	return AddrRange{First: window.Addr(), Last: lastAddr(window), Prefix: window}, true
+}
+
+// networkRange ranks the host ranges of network anchored at each of the
+// machine's local interface addresses using RFC 6724 address selection
+// rules, and returns them best-first, so a dual-stack libvirt_network picks
+// a globally routable v6 slice before a ULA or link-local one. Callers that
+// only want the top choice, or that want to supply their own candidate
+// sources (e.g. in tests), should use SelectPreferredRange instead.
+//
+// When none of the local interface addresses fall inside network -- the
+// common case, since this computes the DHCP range for a subnet that is
+// only just being defined, before any bridge carries an address in it --
+// networkRange falls back to a single range anchored at network's own base
+// address, the same fallback SelectPreferredRange uses. It never returns an
+// empty, non-error slice, so ranges[0] is always safe for callers that just
+// want a range to hand libvirt.
+//
+// It returns a thin net.IP-based HostRange so existing resource schemas
+// keep working unchanged; internally the ranking runs entirely on
+// net/netip.
+func networkRange(network *net.IPNet) ([]HostRange, error) {
+	prefix, err := prefixFromIPNet(network)
+	if err != nil {
+		return nil, err
+	}
+
+	srcs, err := localSourceAddrs()
+	if err != nil {
+		return nil, err
 	}
 
-	return fmt.Sprintf("52:54:00:%02x:%02x:%02x",
-		buf[0], buf[1], buf[2]), nil
+	ranges := rankAddrRanges(prefix, srcs)
+	if len(ranges) == 0 {
+		r, ok := addrRangeContaining(prefix, prefix.Addr())
+		if !ok {
+			return nil, fmt.Errorf("no valid host range in network %s", network)
+		}
+		ranges = []AddrRange{r}
+	}
+
+	hostRanges := make([]HostRange, len(ranges))
+	for i, r := range ranges {
+		hostRanges[i] = HostRange{First: addrToIP(r.First), Last: addrToIP(r.Last)}
+	}
+	return hostRanges, nil
+}
+
+// HostRange is networkRange's public, net.IP-based result type, kept as a
+// thin shim over AddrRange for resource schemas that still deal in net.IP.
+type HostRange struct {
+	First, Last net.IP
+}
+
+// localSourceAddrs returns the machine's local interface addresses as
+// netip.Addr, the form RFC 6724 scoring is expressed in.
+func localSourceAddrs() ([]netip.Addr, error) {
+	ifaceAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := make([]netip.Addr, 0, len(ifaceAddrs))
+	for _, a := range ifaceAddrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if addr, ok := netip.AddrFromSlice(ipNet.IP); ok {
+			addrs = append(addrs, addr.Unmap())
+		}
+	}
+	return addrs, nil
 }
 
-// randomPort returns a random port
-func randomPort() int {
-	const minPort = 1024
-	const maxPort = 65535
+// SelectPreferredRange returns the top RFC 6724-ranked host range of network
+// among the given candidate source addresses, falling back to the range
+// anchored at network's own base address if none of srcs fall inside it
+// (e.g. a sandboxed test run with no matching local interface). It is the
+// thin net.IP-returning shim over rankAddrRanges for public resource
+// schemas that only need the top choice.
+func SelectPreferredRange(network *net.IPNet, srcs []netip.Addr) (first, last net.IP) {
+	prefix, err := prefixFromIPNet(network)
+	if err != nil {
+		return nil, nil
+	}
 
-	rand.Seed(time.Now().UnixNano())
-	return rand.Intn(maxPort-minPort) + minPort
+	if ranges := rankAddrRanges(prefix, srcs); len(ranges) > 0 {
+		return addrToIP(ranges[0].First), addrToIP(ranges[0].Last)
+	}
+
+	r, _ := addrRangeContaining(prefix, prefix.Addr())
+	return addrToIP(r.First), addrToIP(r.Last)
 }
 
-func getNetMaskWithMax16Bits(m net.IPMask) net.IPMask {
-	ones, bits := m.Size()
+// rankAddrRanges scores the AddrRange anchored at each src that falls
+// inside prefix, and returns the distinct ranges sorted best-first.
+// Scoring follows RFC 6724 destination/source address selection, in
+// decreasing priority: (1) address scope (global preferred over
+// site-local/ULA over link-local), (2) longest matching prefix against
+// prefix's own address, (3) native addresses preferred over
+// mapped/6to4/Teredo, and (4) the RFC 6724 policy-table label.
+func rankAddrRanges(prefix netip.Prefix, srcs []netip.Addr) []AddrRange {
+	type scoredRange struct {
+		r     AddrRange
+		score int64
+	}
 
-	if bits-ones > 16 {
-		if bits == 128 {
-			// IPv6 Mask with max 16 bits
-			return net.CIDRMask(128-16, 128)
+	seen := make(map[AddrRange]bool)
+	var candidates []scoredRange
+	for _, src := range srcs {
+		r, ok := addrRangeContaining(prefix, src)
+		if !ok || seen[r] {
+			continue
 		}
+		seen[r] = true
+
+		candidates = append(candidates, scoredRange{r: r, score: rfc6724Score(src, prefix.Addr())})
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].score > candidates[j].score
+	})
 
-		// IPv4 Mask with max 16 bits
-		return net.CIDRMask(32-16, 32)
+	ranges := make([]AddrRange, len(candidates))
+	for i, c := range candidates {
+		ranges[i] = c.r
 	}
+	return ranges
+}
+
+// rfc6724Score combines the four RFC 6724-derived criteria into a single
+// comparable value, weighted so an earlier criterion always dominates ties
+// in a later one.
+func rfc6724Score(addr, network netip.Addr) int64 {
+	scope := int64(addressScope(addr))
+	prefixMatch := int64(commonPrefixLen(addr, network))
+	native := int64(nativePreference(addr))
+	label := int64(labelGoodness(rfc6724Label(addr)))
+
+	return scope*1_000_000 + prefixMatch*1_000 + native*10 + label
+}
+
+// addressScope ranks addr's reachability scope, global being the most
+// preferred for a DHCP range, then ULA/private, link-local and loopback.
+func addressScope(addr netip.Addr) int {
+	switch {
+	case addr.IsLoopback():
+		return 0
+	case addr.IsLinkLocalUnicast(), addr.IsLinkLocalMulticast():
+		return 2
+	case uniqueLocalPrefix.Contains(to6(addr)), addr.IsPrivate():
+		return 5
+	default:
+		return 14
+	}
+}
+
+var uniqueLocalPrefix = netip.MustParsePrefix("fc00::/7")
+
+// to6 normalizes addr to its IPv6 (possibly 4-in-6) form, so it can be
+// compared against the RFC 6724 policy table, which is expressed in v6.
+func to6(addr netip.Addr) netip.Addr {
+	if addr.Is4() {
+		return netip.AddrFrom16(addr.As16())
+	}
+	return addr
+}
+
+// nativePreference penalizes IPv6 addresses that merely tunnel over IPv4
+// (6to4, Teredo) or are IPv4-mapped, in favor of native addresses.
+func nativePreference(addr netip.Addr) int {
+	if addr.Is4() {
+		return 1
+	}
+
+	switch {
+	case addr.Is4In6():
+		return -1
+	case sixToFourPrefix.Contains(addr):
+		return -1
+	case teredoPrefix.Contains(addr):
+		return -1
+	default:
+		return 2
+	}
+}
+
+var (
+	sixToFourPrefix = netip.MustParsePrefix("2002::/16")
+	teredoPrefix    = netip.MustParsePrefix("2001::/32")
+)
+
+// rfc6724Policy is RFC 6724's default policy table (§2.1), used to label an
+// address for destination/source selection.
+var rfc6724Policy = []struct {
+	prefix netip.Prefix
+	label  int
+}{
+	{netip.MustParsePrefix("::1/128"), 0},
+	{netip.MustParsePrefix("::/0"), 1},
+	{netip.MustParsePrefix("2002::/16"), 2},
+	{netip.MustParsePrefix("::/96"), 3},
+	{netip.MustParsePrefix("::ffff:0:0/96"), 4},
+	{netip.MustParsePrefix("fc00::/7"), 5},
+	{netip.MustParsePrefix("2001::/32"), 5},
+	{netip.MustParsePrefix("fec0::/10"), 11},
+	{netip.MustParsePrefix("3ffe::/16"), 12},
+}
+
+func rfc6724Label(addr netip.Addr) int {
+	addr6 := to6(addr)
+
+	label, bestBits := 1, -1
+	for _, p := range rfc6724Policy {
+		if !p.prefix.Contains(addr6) {
+			continue
+		}
+		if p.prefix.Bits() > bestBits {
+			bestBits, label = p.prefix.Bits(), p.label
+		}
+	}
+	return label
+}
 
-	return m
+// labelGoodness turns a raw RFC 6724 label into a monotonic preference
+// value: the default global label (1) ranks highest, the deprecated
+// site-local labels (11, 12) rank lowest.
+func labelGoodness(label int) int {
+	switch label {
+	case 1:
+		return 6
+	case 4:
+		return 5
+	case 3:
+		return 4
+	case 0:
+		return 3
+	case 2, 5:
+		return 2
+	default:
+		return 0
+	}
 }
 
-// networkRange calculates the first and last IP addresses in an IPNet
-func networkRange(network *net.IPNet) (net.IP, net.IP) {
-	netIP := network.IP.To4()
-	lastIP := net.IPv4zero.To4()
-	if netIP == nil {
-		netIP = network.IP.To16()
-		lastIP = net.IPv6zero.To16()
+func commonPrefixLen(a, b netip.Addr) int {
+	a16, b16 := to6(a).As16(), to6(b).As16()
+
+	bits := 0
+	for i := range a16 {
+		xor := a16[i] ^ b16[i]
+		if xor == 0 {
+			bits += 8
+			continue
+		}
+		for mask := byte(0x80); mask > 0 && xor&mask == 0; mask >>= 1 {
+			bits++
+		}
+		break
 	}
-	firstIP := netIP.Mask(network.Mask)
-	// intermediate network mask with max 16 bits for hosts
-	// We need a mask with max 16 bits since libvirt only supports 65535) IP's per subnet
-	// 2^16 = 65536 (minus broadcast and .1)
-	intMask := getNetMaskWithMax16Bits(network.Mask)
+	return bits
+}
 
-	for i := 0; i < len(lastIP); i++ {
-		lastIP[i] = netIP[i] | ^intMask[i]
+// prefixFromIPNet converts a net.IPNet resource-schema value into the
+// netip.Prefix the range-selection engine operates on.
+func prefixFromIPNet(network *net.IPNet) (netip.Prefix, error) {
+	addr, ok := netip.AddrFromSlice(network.IP)
+	if !ok {
+		return netip.Prefix{}, fmt.Errorf("invalid network address %v", network.IP)
 	}
-	return firstIP, lastIP
+	ones, _ := network.Mask.Size()
+	return netip.PrefixFrom(addr.Unmap(), ones).Masked(), nil
+}
+
+// addrToIP converts a netip.Addr back to the net.IP form resource schemas
+// still expose externally.
+func addrToIP(addr netip.Addr) net.IP {
+	return net.IP(addr.AsSlice())
+}
+
+// fileDigest holds the checksum metadata computed when a file is added to
+// fileWebServer, so the serving handler never has to re-read the file to
+// fill in its ETag/Digest headers.
+type fileDigest struct {
+	sha256 string // hex-encoded, suitable for a libvirt_volume "checksum" attribute
+	size   int64
 }
 
 // a HTTP server that serves files in a directory, used mostly for testing
@@ -90,7 +542,18 @@ type fileWebServer struct {
 	Port int
 	URL  string
 
+	// TLS, when set, serves over https using an in-memory self-signed
+	// certificate generated on Start, so acceptance tests can exercise
+	// libvirt_volume sources that require an https:// URL.
+	TLS bool
+	// ClientCAs, when set alongside TLS, requires and verifies a client
+	// certificate signed by one of these CAs (mTLS).
+	ClientCAs *x509.CertPool
+
 	server *http.Server
+
+	mu      sync.Mutex
+	digests map[string]fileDigest
 }
 
 func (fws *fileWebServer) Start() error {
@@ -100,44 +563,187 @@ func (fws *fileWebServer) Start() error {
 	}
 
 	fws.Dir = dir
-	fws.Port = randomPort()
-	fws.URL = fmt.Sprintf("http://127.0.0.1:%d", fws.Port)
+	fws.digests = make(map[string]fileDigest)
 
-	handler := http.NewServeMux()
-	handler.Handle("/", http.FileServer(http.Dir(dir)))
-	fws.server = &http.Server{Addr: fmt.Sprintf("127.0.0.1:%d", fws.Port), Handler: handler}
-	ln, err := net.Listen("tcp", fws.server.Addr)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
 		return err
 	}
+	fws.Port = ln.Addr().(*net.TCPAddr).Port
+
+	scheme := "http"
+	if fws.TLS {
+		cert, err := generateSelfSignedCert(fws.Dir)
+		if err != nil {
+			ln.Close()
+			return err
+		}
+
+		tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+		if fws.ClientCAs != nil {
+			tlsConfig.ClientCAs = fws.ClientCAs
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+
+		ln = tls.NewListener(ln, tlsConfig)
+		scheme = "https"
+	}
+
+	fws.URL = fmt.Sprintf("%s://127.0.0.1:%d", scheme, fws.Port)
+
+	handler := http.NewServeMux()
+	handler.Handle("/", fws.fileHandler())
+	fws.server = &http.Server{Addr: fmt.Sprintf("127.0.0.1:%d", fws.Port), Handler: handler}
 	go fws.server.Serve(ln)
 	return nil
 }
 
-// Adds a file (with some content) in the directory served by the fileWebServer
-func (fws *fileWebServer) AddContent(content []byte) (string, *os.File, error) {
+// generateSelfSignedCert creates an in-memory self-signed certificate for
+// 127.0.0.1/localhost, valid for the lifetime of an acceptance test run, and
+// also writes it (PEM-encoded, alongside its key) under dir so it can be
+// inspected or reused as a client CA.
+func generateSelfSignedCert(dir string) (tls.Certificate, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:              []string{"localhost"},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "server.crt"), certPEM, 0600); err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "server.key"), keyPEM, 0600); err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// fileHandler serves files out of fws.Dir, honoring Range requests (both
+// single and multipart byte ranges, via http.ServeContent) and attaching
+// ETag/Digest headers from the digest computed when the file was added, so
+// callers like libvirt_volume can resume large downloads. Content-Length is
+// set by http.ServeContent for the bytes actually sent.
+func (fws *fileWebServer) fileHandler() http.Handler {
+	dir := http.Dir(fws.Dir)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Base(r.URL.Path)
+
+		f, err := dir.Open(name)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+
+		info, err := f.Stat()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Accept-Ranges", "bytes")
+
+		fws.mu.Lock()
+		digest, ok := fws.digests[name]
+		fws.mu.Unlock()
+		if ok {
+			w.Header().Set("ETag", fmt.Sprintf("%q", digest.sha256))
+			w.Header().Set("Digest", fmt.Sprintf("sha-256=%s", sha256HexToBase64(digest.sha256)))
+		}
+
+		http.ServeContent(w, r, name, info.ModTime(), f)
+	})
+}
+
+// sha256HexToBase64 re-encodes a hex-encoded sha256 sum as base64, the form
+// expected in a RFC 3230 Digest header.
+func sha256HexToBase64(hexSum string) string {
+	raw, err := hex.DecodeString(hexSum)
+	if err != nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(raw)
+}
+
+// Adds a file (with some content) in the directory served by the fileWebServer.
+// It returns the URL the content is reachable at, its sha256 checksum and
+// size, and the backing *os.File so callers can keep writing to it.
+func (fws *fileWebServer) AddContent(content []byte) (string, string, int64, *os.File, error) {
 	tmpfile, err := ioutil.TempFile(fws.Dir, "file-")
 	if err != nil {
-		return "", nil, err
+		return "", "", 0, nil, err
 	}
 
 	if len(content) > 0 {
 		if _, err := tmpfile.Write(content); err != nil {
-			return "", nil, err
+			return "", "", 0, nil, err
 		}
 	}
 
-	return fmt.Sprintf("%s/%s", fws.URL, path.Base(tmpfile.Name())), tmpfile, nil
+	sum := sha256.Sum256(content)
+	checksum := hex.EncodeToString(sum[:])
+	size := int64(len(content))
+
+	name := path.Base(tmpfile.Name())
+	fws.mu.Lock()
+	fws.digests[name] = fileDigest{sha256: checksum, size: size}
+	fws.mu.Unlock()
+
+	return fmt.Sprintf("%s/%s", fws.URL, name), checksum, size, tmpfile, nil
 }
 
-// Symlinks a file into the directory server by the webserver
-func (fws *fileWebServer) AddFile(filePath string) (string, error) {
-	err := os.Symlink(filePath, path.Join(fws.Dir, path.Base(filePath)))
+// Symlinks a file into the directory served by the webserver. It returns the
+// URL the file is reachable at along with its sha256 checksum and size.
+func (fws *fileWebServer) AddFile(filePath string) (string, string, int64, error) {
+	name := path.Base(filePath)
+	if err := os.Symlink(filePath, path.Join(fws.Dir, name)); err != nil {
+		return "", "", 0, err
+	}
+
+	f, err := os.Open(filePath)
 	if err != nil {
-		return "", err
+		return "", "", 0, err
 	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return "", "", 0, err
+	}
+	checksum := hex.EncodeToString(h.Sum(nil))
+
+	fws.mu.Lock()
+	fws.digests[name] = fileDigest{sha256: checksum, size: size}
+	fws.mu.Unlock()
 
-	return fmt.Sprintf("%s/%s", fws.URL, path.Base(filePath)), nil
+	return fmt.Sprintf("%s/%s", fws.URL, name), checksum, size, nil
 }
 
 func (fws *fileWebServer) Stop() {
@@ -0,0 +1,138 @@
+package libvirt
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestMACAllocatorAvoidsCollisions(t *testing.T) {
+	a, err := newMACAllocator(defaultMACOUI, false)
+	if err != nil {
+		t.Fatalf("newMACAllocator: %s", err)
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		mac, err := a.Allocate("", 0)
+		if err != nil {
+			t.Fatalf("Allocate: %s", err)
+		}
+		if seen[mac] {
+			t.Fatalf("Allocate returned duplicate MAC %s", mac)
+		}
+		seen[mac] = true
+	}
+}
+
+func TestMACAllocatorDeterministic(t *testing.T) {
+	a, err := newMACAllocator(defaultMACOUI, true)
+	if err != nil {
+		t.Fatalf("newMACAllocator: %s", err)
+	}
+
+	first, err := a.Allocate("my-domain", 0)
+	if err != nil {
+		t.Fatalf("Allocate: %s", err)
+	}
+
+	b, err := newMACAllocator(defaultMACOUI, true)
+	if err != nil {
+		t.Fatalf("newMACAllocator: %s", err)
+	}
+	second, err := b.Allocate("my-domain", 0)
+	if err != nil {
+		t.Fatalf("Allocate: %s", err)
+	}
+
+	if first != second {
+		t.Fatalf("deterministic allocations differ across allocators: %s != %s", first, second)
+	}
+
+	third, err := a.Allocate("my-domain", 1)
+	if err != nil {
+		t.Fatalf("Allocate: %s", err)
+	}
+	if third == first {
+		t.Fatalf("allocations for different iface indexes should differ, both got %s", first)
+	}
+}
+
+func TestParseMACOUI(t *testing.T) {
+	oui, err := parseMACOUI("")
+	if err != nil {
+		t.Fatalf("parseMACOUI(\"\"): %s", err)
+	}
+	if oui != [3]byte{0x52, 0x54, 0x00} {
+		t.Fatalf("parseMACOUI(\"\") = %v, want default OUI", oui)
+	}
+
+	oui, err = parseMACOUI("aa:bb:cc")
+	if err != nil {
+		t.Fatalf("parseMACOUI(\"aa:bb:cc\"): %s", err)
+	}
+	if oui != [3]byte{0xaa, 0xbb, 0xcc} {
+		t.Fatalf("parseMACOUI(\"aa:bb:cc\") = %v", oui)
+	}
+
+	if _, err := parseMACOUI("aa:bb"); err == nil {
+		t.Fatal("expected error for malformed mac_oui")
+	}
+}
+
+// TestNetworkRangeNoLocalMatch reproduces a newly defined libvirt_network
+// subnet that none of the host's local interface addresses fall inside
+// (the common case: the DHCP range is computed before anything carries an
+// address on it). networkRange must still return a usable range rather
+// than an empty, non-error slice.
+func TestNetworkRangeNoLocalMatch(t *testing.T) {
+	_, network, err := net.ParseCIDR("10.55.0.0/24")
+	if err != nil {
+		t.Fatalf("ParseCIDR: %s", err)
+	}
+
+	ranges, err := networkRange(network)
+	if err != nil {
+		t.Fatalf("networkRange: %s", err)
+	}
+	if len(ranges) == 0 {
+		t.Fatal("networkRange returned no ranges for an unmatched network")
+	}
+
+	first, last := ranges[0].First, ranges[0].Last
+	if !network.Contains(first) || !network.Contains(last) {
+		t.Fatalf("range [%s, %s] is not within %s", first, last, network)
+	}
+}
+
+// TestSelectPreferredRangePrefersLongerPrefixMatch checks RFC 6724 rule (2):
+// among candidate local addresses within the same network, the one sharing
+// the longer matching prefix with the network's own address ranks first.
+func TestSelectPreferredRangePrefersLongerPrefixMatch(t *testing.T) {
+	_, network, err := net.ParseCIDR("2001:db8::/32")
+	if err != nil {
+		t.Fatalf("ParseCIDR: %s", err)
+	}
+
+	closeAddr := netip.MustParseAddr("2001:db8::5")
+	farAddr := netip.MustParseAddr("2001:db8:ffff:ffff::5")
+
+	first, last := SelectPreferredRange(network, []netip.Addr{farAddr, closeAddr})
+
+	want, ok := addrRangeContaining(mustPrefixFromIPNet(t, network), closeAddr)
+	if !ok {
+		t.Fatal("expected the closer address to produce a valid range")
+	}
+	if !first.Equal(net.IP(want.First.AsSlice())) || !last.Equal(net.IP(want.Last.AsSlice())) {
+		t.Fatalf("SelectPreferredRange did not prefer the longer prefix match: got [%s, %s]", first, last)
+	}
+}
+
+func mustPrefixFromIPNet(t *testing.T, network *net.IPNet) netip.Prefix {
+	t.Helper()
+	prefix, err := prefixFromIPNet(network)
+	if err != nil {
+		t.Fatalf("prefixFromIPNet: %s", err)
+	}
+	return prefix
+}